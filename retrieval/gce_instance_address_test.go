@@ -0,0 +1,87 @@
+package retrieval
+
+import (
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestInstanceAddress(t *testing.T) {
+	withInterface := func(networkIP string, accessConfigs []*compute.AccessConfig) *compute.Instance {
+		return &compute.Instance{
+			Name: "instance-1",
+			NetworkInterfaces: []*compute.NetworkInterface{
+				{NetworkIP: networkIP, AccessConfigs: accessConfigs},
+			},
+		}
+	}
+
+	cases := []struct {
+		name        string
+		inst        *compute.Instance
+		addressType string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "internal address",
+			inst:        withInterface("10.0.0.5", nil),
+			addressType: gceAddressTypeInternal,
+			want:        "10.0.0.5",
+		},
+		{
+			name:        "external address",
+			inst:        withInterface("10.0.0.5", []*compute.AccessConfig{{NatIP: "203.0.113.1"}}),
+			addressType: gceAddressTypeExternal,
+			want:        "203.0.113.1",
+		},
+		{
+			name:        "external address missing access config",
+			inst:        withInterface("10.0.0.5", nil),
+			addressType: gceAddressTypeExternal,
+			wantErr:     true,
+		},
+		{
+			name:        "external address with empty NatIP",
+			inst:        withInterface("10.0.0.5", []*compute.AccessConfig{{NatIP: ""}}),
+			addressType: gceAddressTypeExternal,
+			wantErr:     true,
+		},
+		{
+			name:        "dns address type leaves resolution to the caller",
+			inst:        withInterface("10.0.0.5", nil),
+			addressType: gceAddressTypeDns,
+			want:        "",
+		},
+		{
+			name:        "no network interfaces",
+			inst:        &compute.Instance{Name: "instance-1"},
+			addressType: gceAddressTypeInternal,
+			wantErr:     true,
+		},
+		{
+			name:        "unsupported address type",
+			inst:        withInterface("10.0.0.5", nil),
+			addressType: "Internal",
+			wantErr:     true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := instanceAddress(c.inst, c.addressType)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("instanceAddress() = %q, <nil>, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("instanceAddress() returned unexpected error: %s", err)
+			}
+			if got != c.want {
+				t.Fatalf("instanceAddress() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package retrieval
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestInstanceLabels(t *testing.T) {
+	metadataValue := "bar"
+	inst := &compute.Instance{
+		MachineType: "https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-a/machineTypes/n1-standard-1",
+		Tags:        &compute.Tags{Items: []string{"web", "prod"}},
+		Labels:      map[string]string{"env": "prod"},
+		Metadata: &compute.Metadata{
+			Items: []*compute.MetadataItems{
+				{Key: "foo", Value: &metadataValue},
+				{Key: "no-value", Value: nil},
+			},
+		},
+		NetworkInterfaces: []*compute.NetworkInterface{
+			{
+				NetworkIP:     "10.0.0.5",
+				AccessConfigs: []*compute.AccessConfig{{NatIP: "203.0.113.1"}},
+			},
+		},
+	}
+
+	got := instanceLabels(inst)
+
+	want := clientmodel.LabelSet{
+		"__meta_gce_machine_type": "n1-standard-1",
+		"__meta_gce_tag":          "web,prod",
+		"__meta_gce_label_env":    "prod",
+		"__meta_gce_metadata_foo": "bar",
+		"__meta_gce_private_ip":   "10.0.0.5",
+		"__meta_gce_public_ip":    "203.0.113.1",
+	}
+
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("label %s = %q, want %q", name, got[name], value)
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			t.Errorf("unexpected label %s = %q", name, got[name])
+		}
+	}
+}
+
+func TestInstanceLabelsOmitsUnsetOptionalLabels(t *testing.T) {
+	inst := &compute.Instance{
+		MachineType: "projects/p/zones/us-central1-a/machineTypes/n1-standard-1",
+	}
+
+	got := instanceLabels(inst)
+
+	for _, name := range []clientmodel.LabelName{
+		"__meta_gce_tag",
+		"__meta_gce_private_ip",
+		"__meta_gce_public_ip",
+	} {
+		if _, ok := got[name]; ok {
+			t.Errorf("got label %s = %q, want it omitted when the instance has no value for it", name, got[name])
+		}
+	}
+	if got["__meta_gce_machine_type"] != "n1-standard-1" {
+		t.Errorf("__meta_gce_machine_type = %q, want %q", got["__meta_gce_machine_type"], "n1-standard-1")
+	}
+}
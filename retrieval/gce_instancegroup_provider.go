@@ -1,15 +1,26 @@
 package retrieval
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
+	"cloud.google.com/go/compute/metadata"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
 
@@ -18,49 +29,99 @@ import (
 	"github.com/prometheus/prometheus/config"
 )
 
+// gceOauthScopes are the scopes requested when no credentials_file is given
+// and we fall back to Application Default Credentials.
+var gceOauthScopes = []string{compute.ComputeReadonlyScope}
+
+// Supported values for the job's address_type GCE discovery option.
+const (
+	gceAddressTypeDns      = "dns"
+	gceAddressTypeInternal = "internal"
+	gceAddressTypeExternal = "external"
+)
+
+const (
+	// zoneCacheTTL bounds how long a project's zone list is reused before
+	// the Zones.List endpoint is hit again.
+	zoneCacheTTL = time.Hour
+	// zoneDiscoveryConcurrency caps how many zones are listed for
+	// matching instance groups at once, to stay within compute API quota
+	// on large projects.
+	zoneDiscoveryConcurrency = 10
+)
+
+const (
+	// defaultMaxRetries and defaultMaxRetryDuration bound retries of
+	// outbound GCE calls when the job doesn't set max_retries /
+	// max_retry_duration explicitly.
+	defaultMaxRetries       = 5
+	defaultMaxRetryDuration = 30 * time.Second
+
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+)
+
+// gceProviderName is this provider's discriminator: the value of the
+// "provider" label on the shared sd_discovery_failures_total /
+// sd_discovered_targets metrics, and the key other SD backends avoid when
+// registering their own factories.
+const gceProviderName = "gce"
+
 var (
-	gceDiscoveryFailuresCount = prometheus.NewCounter(
+	sdDiscoveryFailuresCount = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
-			Name:	  "gce_discovery_failures_total",
-			Help:	  "The number of GCE backend service discovery failures.",
-		})
+			Name:	  "sd_discovery_failures_total",
+			Help:	  "The number of service discovery failures, by provider and reason.",
+		},
+		[]string{"provider", "reason"})
 
-	gceDiscoveryClientBackends = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	sdDiscoveredTargets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
-			Name: "gce_targets",
-			Help: "Number of instances discovered for each instance group.",
+			Name: "sd_discovered_targets",
+			Help: "Number of targets discovered by each service discovery provider.",
 		},
-		[]string{"zone", "instance_group"})
+		[]string{"provider", "zone", "instance_group"})
 )
 
 func init() {
-	prometheus.MustRegister(gceDiscoveryFailuresCount)
-	prometheus.MustRegister(gceDiscoveryClientBackends)
-}
+	prometheus.MustRegister(sdDiscoveryFailuresCount)
+	prometheus.MustRegister(sdDiscoveredTargets)
 
-type _gceLBBackend struct {
-	instanceName string
-	resourceUrl string
+	RegisterTargetProvider(gceProviderName,
+		func(job config.JobConfig) bool { return job.GetGceDiscovery() != nil },
+		func(job config.JobConfig, globalLabels clientmodel.LabelSet) TargetProvider {
+			return NewGceInstanceGroupProvider(job, globalLabels)
+		})
 }
 
 type gceInstanceGroupProvider struct {
 	job config.JobConfig
 
-	apiClient *http.Client
-	authHeader string
-	tokenExpires time.Time
+	apiClient   *http.Client
+	tokenSource oauth2.TokenSource
+
+	computeService *compute.Service
 
-	backends map[string]*_gceLBBackend
+	zoneCacheMu     sync.Mutex
+	zoneCache       []string
+	zoneCacheExpiry time.Time
 
 	globalLabels clientmodel.LabelSet
 	targets	  []Target
 }
 
+// groupRef identifies a single instance group to resolve into targets,
+// whether it came from an explicit (zone, group_name) config entry or from
+// project-wide zone auto-discovery.
+type groupRef struct {
+	zone string
+	name string
+}
+
 // NewGceInstanceGroupProvider constructs a new gceInstanceGroupProvider for a job.
 func NewGceInstanceGroupProvider(job config.JobConfig, globalLabels clientmodel.LabelSet) *gceInstanceGroupProvider {
 	lb := &gceInstanceGroupProvider{
-		backends: make(map[string]*_gceLBBackend),
 		job:			 job,
 	 	globalLabels:	globalLabels,
 	}
@@ -73,180 +134,522 @@ func NewGceInstanceGroupProvider(job config.JobConfig, globalLabels clientmodel.
 	return lb
 }
 
-// Per: https://cloud.google.com/compute/docs/authentication
+// refreshAccessToken makes sure lb.tokenSource is set up, resolving
+// Application Default Credentials on first use: a credentials_file
+// configured on the job takes precedence, followed by
+// GOOGLE_APPLICATION_CREDENTIALS, gcloud's user credentials, and finally
+// the GCE metadata server's service account. The returned
+// oauth2.TokenSource takes care of caching and refreshing the token
+// itself, so callers just call Token() on every request.
+//
+// Per: https://cloud.google.com/docs/authentication/production
 func (lb *gceInstanceGroupProvider) refreshAccessToken() error {
-	if len(lb.authHeader) > 0 && lb.tokenExpires.After(time.Now()) {
-		// Still valid.
+	if lb.tokenSource != nil {
 		return nil
 	}
 
-	lb.authHeader = ""
+	ctx := context.Background()
 
-	accessTokenUrl :=
-		fmt.Sprintf("http://metadata/computeMetadata/v1/instance/service-accounts/%s/token",
-			lb.job.GetGceDiscovery().GetServiceAccount())
-	req, _ := http.NewRequest("GET", accessTokenUrl, nil)
-	req.Header.Add("Metadata-Flavor", "Google" )
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+	if credentialsFile := lb.job.GetGceDiscovery().GetCredentialsFile(); len(credentialsFile) > 0 {
+		data, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			glog.Errorf("Read credentials_file %s: %s", credentialsFile, err)
+			sdDiscoveryFailuresCount.WithLabelValues(gceProviderName, "auth").Inc()
+			return err
+		}
+		creds, err := google.CredentialsFromJSON(ctx, data, gceOauthScopes...)
+		if err != nil {
+			glog.Errorf("Parse credentials_file %s: %s", credentialsFile, err)
+			sdDiscoveryFailuresCount.WithLabelValues(gceProviderName, "parse").Inc()
+			return err
+		}
+		lb.tokenSource = creds.TokenSource
+		return nil
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		glog.Errorf("Read token response: %s", err)
-		return err
+
+	return lb.withRetry("auth", func() error {
+		creds, err := google.FindDefaultCredentials(ctx, gceOauthScopes...)
+		if err != nil {
+			glog.Errorf("Find default credentials: %s", err)
+			return err
+		}
+		lb.tokenSource = creds.TokenSource
+		return nil
+	})
+}
+
+// resolveProject returns the job's configured project, falling back to the
+// project of the instance Prometheus itself is running on (read from the
+// GCE metadata server via cloud.google.com/go/compute/metadata) when the
+// job doesn't set one explicitly. This mirrors how gcloud and other GCE
+// client libraries behave when no project is given.
+func (lb *gceInstanceGroupProvider) resolveProject() (string, error) {
+	if project := lb.job.GetGceDiscovery().GetProject(); len(project) > 0 {
+		return project, nil
 	}
-	// {"access_token":"ya29.XAE9ZoxvmWXrdqsfjd9ORctCcafAwOZpMKclr2yfIMAGZBxmpSRZbKXK","expires_in":3599,"token_type":"Bearer"}
 
-	var tokenResponse struct{
-		AccessToken string	  `json:"access_token"`
-		ExpiresInSec int		`json:"expires_in"`
-		TokenType string		`json:"token_type"`
+	if !metadata.OnGCE() {
+		return "", fmt.Errorf("gce_discovery has no project set and we're not running on GCE")
 	}
-	err = json.Unmarshal(body, &tokenResponse)
+
+	project, err := metadata.ProjectID()
 	if err != nil {
-		glog.Errorf("Parse token response: %s", err)
-		return  err
+		glog.Errorf("Read project ID from GCE metadata: %s", err)
+		sdDiscoveryFailuresCount.WithLabelValues(gceProviderName, failureReason(err, "auth")).Inc()
+		return "", err
 	}
 
-	token := tokenResponse.AccessToken
+	return project, nil
+}
 
-	if len(token) == 0 {
-		return fmt.Errorf("Empty access token.")
+// ensureComputeService lazily builds the compute/v1 API client on top of
+// lb.tokenSource, authorizing it via the apiClient's transport (so the
+// configured api_proxy_url, if any, is honored).
+func (lb *gceInstanceGroupProvider) ensureComputeService() error {
+	if lb.computeService != nil {
+		return nil
 	}
 
-	lb.authHeader = fmt.Sprintf("%s %s", tokenResponse.TokenType, token)
-	lb.tokenExpires = time.Now().Add(time.Duration(tokenResponse.ExpiresInSec) * time.Second)
+	if err := lb.refreshAccessToken(); err != nil {
+		return err
+	}
 
-	glog.Infof("**** Refreshed %s access token, expires in %d sec", tokenResponse.TokenType, tokenResponse.ExpiresInSec)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, lb.apiClient)
+	httpClient := oauth2.NewClient(ctx, lb.tokenSource)
+
+	service, err := compute.New(httpClient)
+	if err != nil {
+		glog.Errorf("Create compute API client: %s", err)
+		sdDiscoveryFailuresCount.WithLabelValues(gceProviderName, "network").Inc()
+		return err
+	}
+	lb.computeService = service
 
 	return nil
 }
 
-type _gceApiErrorJson struct {
-	Code int							`json:"code"`
-	Message string					  `json:"message"`
+// asNetError unwraps the net.Error carried by err, if any, including one
+// wrapped inside a *url.Error as returned by http.Client.Do.
+func asNetError(err error) (net.Error, bool) {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	netErr, ok := err.(net.Error)
+	return netErr, ok
 }
 
-type _gceApiResponseJson struct {
-	Error *_gceApiErrorJson				`json:"error"`
+// rateLimitReasons are the googleapi.Error reasons GCE uses on an HTTP 403
+// when the caller should back off and retry rather than treating the
+// request as permanently denied.
+var rateLimitReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
 }
 
-type _gceLabelJson struct {
-	Key string						`json:"key"`
-	Value string					`json:"value"`
+// isRetryableError reports whether err looks like a transient failure worth
+// retrying: temporary or timed-out network errors, HTTP 429/5xx responses, and the HTTP 403
+// quota-exceeded variants the compute API uses instead of 429.
+func isRetryableError(err error) bool {
+	if netErr, ok := asNetError(err); ok {
+		return netErr.Temporary() || netErr.Timeout()
+	}
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		if apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500 {
+			return true
+		}
+		if apiErr.Code == http.StatusForbidden {
+			for _, e := range apiErr.Errors {
+				if rateLimitReasons[e.Reason] {
+					return true
+				}
+			}
+		}
+	}
+	return false
 }
-type _gceEndpointJson struct {
-	Name string						`json:"name"`
-	Port int						`json:"port"`
+
+// failureReason classifies err for the sd_discovery_failures_total reason
+// label: network-level failures are always tagged "network" regardless of
+// which GCE call hit them, so the metric can actually tell connectivity
+// problems apart from the API itself erroring; anything else falls back to
+// the reason supplied by the caller (e.g. "auth", "list").
+func failureReason(err error, fallback string) string {
+	if _, ok := asNetError(err); ok {
+		return "network"
+	}
+	return fallback
 }
 
-// Known as "resourceView" in the v1beta2 API.
-type _gceInstanceGroupJson struct {
-	_gceApiResponseJson
-
-	Kind string						`json:"kind"`
-	Name string						`json:"name"`
-	Description string				`json:"name"`
-	Size int						`json:"size"`
-	CreationTimestamp string		`json:"creationTimestamp"`
-	Resources []string				`json:"resources"`
-	Id string						`json:"id"`
-	SelfLink string				 	`json:"selfLink"`
-	Labels []_gceLabelJson			`json:"labels"`
-	Endpoints []_gceEndpointJson	`json:"endpoints"`
-	Network string					`json:"network"`
-	Fingerprint string				`json:"fingerprint"`
+// backoffDelay returns the delay before retry attempt n (0-based),
+// exponential in n and capped at retryMaxDelay, with up to 50% jitter to
+// avoid every job retrying in lockstep.
+func backoffDelay(attempt int) time.Duration {
+	delay := retryBaseDelay * time.Duration(uint64(1)<<uint(attempt))
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)/2+1))
 }
 
-func (lb *gceInstanceGroupProvider) getInstanceGroupResources(zone, instance_group string) ([]string, error) {
-	getInstanceGroupUrl :=
-		fmt.Sprintf("https://www.googleapis.com/resourceviews/v1beta2/projects/%s/zones/%s/resourceViews/%s",
-			lb.job.GetGceDiscovery().GetProject(),
-			zone, instance_group)
+// withRetry runs fn, retrying retryable errors with exponential backoff and
+// jitter, bounded by the job's max_retries and max_retry_duration GCE
+// discovery options (or the package defaults). On final failure it bumps
+// sd_discovery_failures_total with the reason label failureReason picks:
+// "network" for network-level errors, the given reason otherwise.
+func (lb *gceInstanceGroupProvider) withRetry(reason string, fn func() error) error {
+	maxRetries := int(lb.job.GetGceDiscovery().GetMaxRetries())
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+	maxDuration := time.Duration(lb.job.GetGceDiscovery().GetMaxRetryDurationSeconds()) * time.Second
+	if maxDuration <= 0 {
+		maxDuration = defaultMaxRetryDuration
+	}
 
-	req, _ := http.NewRequest("GET", getInstanceGroupUrl, nil)
-	req.Header.Add("Authorization", lb.authHeader)
-	resp, err := lb.apiClient.Do(req)
-	if err != nil {
-		return nil, err
+	start := time.Now()
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if !isRetryableError(err) || attempt >= maxRetries || time.Since(start) >= maxDuration {
+			break
+		}
+		glog.Warningf("Retrying GCE %s call (attempt %d) after error: %s", reason, attempt+1, err)
+		time.Sleep(backoffDelay(attempt))
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+
+	sdDiscoveryFailuresCount.WithLabelValues(gceProviderName, failureReason(err, reason)).Inc()
+	return err
+}
+
+// instanceGroupMemberNames returns the short instance names of every member
+// of the given (zone, instance_group) managed or unmanaged instance group.
+func (lb *gceInstanceGroupProvider) instanceGroupMemberNames(zone, instanceGroup string) ([]string, error) {
+	project, err := lb.resolveProject()
 	if err != nil {
-		glog.Errorf("Read instance group %s/%s: %s", zone, instance_group, err)
 		return nil, err
 	}
 
-	var group _gceInstanceGroupJson
-	err = json.Unmarshal(body, &group)
+	req := &compute.InstanceGroupsListInstancesRequest{
+		InstanceState: "ALL",
+	}
+
+	var names []string
+	err = lb.withRetry("list", func() error {
+		names = nil
+		call := lb.computeService.InstanceGroups.ListInstances(project, zone, instanceGroup, req)
+		return call.Pages(context.Background(), func(page *compute.InstanceGroupsListInstances) error {
+			for _, item := range page.Items {
+				names = append(names, item.Instance[strings.LastIndex(item.Instance, "/")+1:])
+			}
+			return nil
+		})
+	})
 	if err != nil {
-		glog.Errorf("Parse instance group: %s", err)
+		glog.Errorf("List instances in group %s/%s: %s", zone, instanceGroup, err)
 		return nil, err
 	}
 
-	if group.Error != nil && len(group.Error.Message) > 0 {
-		return nil, errors.New(group.Error.Message)
+	return names, nil
+}
+
+// aggregatedInstances fetches every instance in the project, keyed by short
+// instance name, in a single (paginated) Instances.AggregatedList call. This
+// is far cheaper than issuing an Instances.Get per member once groups grow
+// past a handful of instances.
+func (lb *gceInstanceGroupProvider) aggregatedInstances(project string) (map[string]*compute.Instance, error) {
+	var instances map[string]*compute.Instance
+
+	err := lb.withRetry("list", func() error {
+		instances = make(map[string]*compute.Instance)
+		call := lb.computeService.Instances.AggregatedList(project)
+		return call.Pages(context.Background(), func(page *compute.InstanceAggregatedList) error {
+			for _, scoped := range page.Items {
+				for _, inst := range scoped.Instances {
+					instances[inst.Name] = inst
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		glog.Errorf("Aggregated list of instances in project %s: %s", project, err)
+		return nil, err
 	}
 
-	return group.Resources, nil
+	return instances, nil
 }
 
-func (lb *gceInstanceGroupProvider) getBackendList(zone, instance_group string) ([]*_gceLBBackend, error) {
-	// Get access token.
-	err := lb.refreshAccessToken()
+// listZones returns every zone in project, reusing a cached list for up to
+// zoneCacheTTL so that project-wide auto-discovery doesn't hit the zones
+// endpoint on every scrape refresh.
+func (lb *gceInstanceGroupProvider) listZones(project string) ([]string, error) {
+	lb.zoneCacheMu.Lock()
+	defer lb.zoneCacheMu.Unlock()
+
+	if lb.zoneCache != nil && time.Now().Before(lb.zoneCacheExpiry) {
+		return lb.zoneCache, nil
+	}
+
+	var zones []string
+	err := lb.withRetry("list", func() error {
+		zones = nil
+		call := lb.computeService.Zones.List(project)
+		return call.Pages(context.Background(), func(page *compute.ZoneList) error {
+			for _, zone := range page.Items {
+				zones = append(zones, zone.Name)
+			}
+			return nil
+		})
+	})
 	if err != nil {
+		glog.Errorf("List zones in project %s: %s", project, err)
 		return nil, err
 	}
 
-	resources, err := lb.getInstanceGroupResources(zone, instance_group)
+	lb.zoneCache = zones
+	lb.zoneCacheExpiry = time.Now().Add(zoneCacheTTL)
+
+	return zones, nil
+}
+
+// discoverGroups fans out across every zone in project looking for instance
+// groups matching the job's group_name_regex and/or filter GCE discovery
+// options, using a bounded worker pool so large projects don't blow through
+// the compute API quota.
+func (lb *gceInstanceGroupProvider) discoverGroups(project string) ([]groupRef, error) {
+	nameRegexStr := lb.job.GetGceDiscovery().GetGroupNameRegex()
+	var nameRegex *regexp.Regexp
+	if len(nameRegexStr) > 0 {
+		var err error
+		nameRegex, err = regexp.Compile(nameRegexStr)
+		if err != nil {
+			glog.Errorf("Compile group_name_regex %q: %s", nameRegexStr, err)
+			return nil, err
+		}
+	}
+	filter := lb.job.GetGceDiscovery().GetFilter()
+
+	zones, err := lb.listZones(project)
 	if err != nil {
 		return nil, err
 	}
 
-	var backends []*_gceLBBackend
-	for _, resource := range resources {
-		shortName := resource[strings.LastIndex(resource, "/") + 1:]
-		backends = append(backends, &_gceLBBackend{
-			instanceName: shortName,
-			resourceUrl: resource,
+	return fanOutZoneListing(zones, zoneDiscoveryConcurrency, func(zone string) ([]groupRef, error) {
+		var matched []groupRef
+		err := lb.withRetry("list", func() error {
+			matched = nil
+			call := lb.computeService.InstanceGroups.List(project, zone)
+			if len(filter) > 0 {
+				call = call.Filter(filter)
+			}
+			return call.Pages(context.Background(), func(page *compute.InstanceGroupList) error {
+				for _, ig := range page.Items {
+					if nameRegex != nil && !nameRegex.MatchString(ig.Name) {
+						continue
+					}
+					matched = append(matched, groupRef{zone: zone, name: ig.Name})
+				}
+				return nil
+			})
 		})
+		return matched, err
+	})
+}
+
+// fanOutZoneListing lists groups across zones concurrently, bounded to at
+// most concurrency zones in flight at once, and merges the per-zone results.
+//
+// A single bad zone (disabled for the project, a transient error that
+// outlasts the retry budget, ...) must not blow away everything the other
+// zones already found: fanOutZoneListing skips it and keeps going. It only
+// treats zone listing as having failed outright if list returned an error
+// for every zone.
+func fanOutZoneListing(zones []string, concurrency int, list func(zone string) ([]groupRef, error)) ([]groupRef, error) {
+	var (
+		wg         sync.WaitGroup
+		sem        = make(chan struct{}, concurrency)
+		mu         sync.Mutex
+		groups     []groupRef
+		zoneErrors []error
+	)
+
+	for _, zone := range zones {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(zone string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			matched, listErr := list(zone)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if listErr != nil {
+				glog.Warningf("Skipping zone %s: list instance groups: %s", zone, listErr)
+				zoneErrors = append(zoneErrors, fmt.Errorf("zone %s: %s", zone, listErr))
+				return
+			}
+			groups = append(groups, matched...)
+		}(zone)
 	}
+	wg.Wait()
 
-	return backends, nil
+	if len(zoneErrors) > 0 && len(zoneErrors) == len(zones) {
+		return nil, fmt.Errorf("failed to list instance groups in all %d zones, first error: %s", len(zones), zoneErrors[0])
+	}
+
+	return groups, nil
 }
 
-func (lb *gceInstanceGroupProvider) Targets() ([]Target, error) {
-	var err error
-	defer func() {
-		if err != nil {
-			gceDiscoveryFailuresCount.Inc()
+// resolveGroups returns the groups a job's Targets() call should resolve:
+// the job's explicit (zone, group_name) entries if any are configured,
+// otherwise every group in project matching discoverGroups.
+func (lb *gceInstanceGroupProvider) resolveGroups(project string) ([]groupRef, error) {
+	explicit := lb.job.GetGceDiscovery().Groups
+	if len(explicit) > 0 {
+		refs := make([]groupRef, 0, len(explicit))
+		for _, g := range explicit {
+			refs = append(refs, groupRef{zone: g.GetZone(), name: g.GetGroupName()})
+		}
+		return refs, nil
+	}
+
+	return lb.discoverGroups(project)
+}
+
+// instanceAddress returns the host Prometheus should scrape for inst,
+// according to the job's address_type GCE discovery option.
+func instanceAddress(inst *compute.Instance, addressType string) (string, error) {
+	if len(inst.NetworkInterfaces) == 0 {
+		return "", fmt.Errorf("instance %s has no network interfaces", inst.Name)
+	}
+	iface := inst.NetworkInterfaces[0]
+
+	switch addressType {
+	case gceAddressTypeDns:
+		// The caller builds the DNS name itself from the instance name; there's
+		// nothing for instanceAddress to resolve.
+		return "", nil
+	case gceAddressTypeInternal:
+		return iface.NetworkIP, nil
+	case gceAddressTypeExternal:
+		if len(iface.AccessConfigs) == 0 || len(iface.AccessConfigs[0].NatIP) == 0 {
+			return "", fmt.Errorf("instance %s has no external IP", inst.Name)
 		}
-	}()
+		return iface.AccessConfigs[0].NatIP, nil
+	default:
+		return "", fmt.Errorf("unsupported address_type %q", addressType)
+	}
+}
+
+// instanceLabels builds the __meta_gce_* labels describing inst.
+func instanceLabels(inst *compute.Instance) clientmodel.LabelSet {
+	labels := clientmodel.LabelSet{}
+
+	labels[clientmodel.LabelName("__meta_gce_machine_type")] =
+		clientmodel.LabelValue(inst.MachineType[strings.LastIndex(inst.MachineType, "/")+1:])
+
+	if inst.Tags != nil && len(inst.Tags.Items) > 0 {
+		labels[clientmodel.LabelName("__meta_gce_tag")] =
+			clientmodel.LabelValue(strings.Join(inst.Tags.Items, ","))
+	}
+
+	for k, v := range inst.Labels {
+		labels[clientmodel.LabelName("__meta_gce_label_"+k)] = clientmodel.LabelValue(v)
+	}
+
+	if inst.Metadata != nil {
+		for _, item := range inst.Metadata.Items {
+			if item.Value != nil {
+				labels[clientmodel.LabelName("__meta_gce_metadata_"+item.Key)] = clientmodel.LabelValue(*item.Value)
+			}
+		}
+	}
+
+	if len(inst.NetworkInterfaces) > 0 {
+		iface := inst.NetworkInterfaces[0]
+		if len(iface.NetworkIP) > 0 {
+			labels[clientmodel.LabelName("__meta_gce_private_ip")] = clientmodel.LabelValue(iface.NetworkIP)
+		}
+		if len(iface.AccessConfigs) > 0 && len(iface.AccessConfigs[0].NatIP) > 0 {
+			labels[clientmodel.LabelName("__meta_gce_public_ip")] = clientmodel.LabelValue(iface.AccessConfigs[0].NatIP)
+		}
+	}
+
+	return labels
+}
+
+// Targets implements the TargetProvider interface. On a transient failure it
+// keeps serving the last successfully discovered target list (lb.targets)
+// rather than emptying the scrape pool for the job; lb.targets is only
+// overwritten once a refresh fully succeeds.
+func (lb *gceInstanceGroupProvider) Targets() ([]Target, error) {
+	if err := lb.ensureComputeService(); err != nil {
+		return lb.targets, err
+	}
+
+	project, err := lb.resolveProject()
+	if err != nil {
+		return lb.targets, err
+	}
+
+	allInstances, err := lb.aggregatedInstances(project)
+	if err != nil {
+		return lb.targets, err
+	}
+
+	addressType := lb.job.GetGceDiscovery().GetAddressType()
+	if len(addressType) == 0 {
+		addressType = gceAddressTypeDns
+	}
+
+	groups, err := lb.resolveGroups(project)
+	if err != nil {
+		glog.Warningf("Failed to resolve instance groups: %s", err)
+		return lb.targets, err
+	}
 
 	targets := make([]Target, 0, len(lb.targets))
 
-	for _, group := range(lb.job.GetGceDiscovery().Groups) {
+	for _, group := range groups {
 		baseLabels := clientmodel.LabelSet{
 			clientmodel.JobLabel: clientmodel.LabelValue(lb.job.GetName()),
 		}
 		for n, v := range lb.globalLabels {
 			baseLabels[n] = v
 		}
-		baseLabels[clientmodel.LabelName("zone")] = clientmodel.LabelValue(group.GetZone())
-		baseLabels[clientmodel.LabelName("instance_group")] = clientmodel.LabelValue(group.GetGroupName())
+		baseLabels[clientmodel.LabelName("zone")] = clientmodel.LabelValue(group.zone)
+		baseLabels[clientmodel.LabelName("instance_group")] = clientmodel.LabelValue(group.name)
 
-		newBackendList, err := lb.getBackendList(group.GetZone(), group.GetGroupName())
-		if err != nil {
-			glog.Warningf("Failed to fetch backend list: %s", err)
-			return nil, err
+		memberNames, memberErr := lb.instanceGroupMemberNames(group.zone, group.name)
+		if memberErr != nil {
+			glog.Warningf("Failed to fetch instance group members: %s", memberErr)
+			return lb.targets, memberErr
 		}
+
+		var running []*compute.Instance
+		for _, name := range memberNames {
+			inst, ok := allInstances[name]
+			if !ok {
+				glog.Warningf("Instance %s listed in group %s/%s but missing from aggregated list",
+					name, group.zone, group.name)
+				continue
+			}
+			if inst.Status != "RUNNING" {
+				continue
+			}
+			running = append(running, inst)
+		}
+
 		exportLabels := prometheus.Labels{
-			"zone":group.GetZone(),
-			"instance_group":group.GetGroupName(),
+			"provider":       gceProviderName,
+			"zone":           group.zone,
+			"instance_group": group.name,
 		}
-		gceDiscoveryClientBackends.With(exportLabels).Set(float64(len(newBackendList)))
+		sdDiscoveredTargets.With(exportLabels).Set(float64(len(running)))
 
 		endpoint := &url.URL{
 			Scheme: "http",
@@ -256,12 +659,27 @@ func (lb *gceInstanceGroupProvider) Targets() ([]Target, error) {
 		if len(lb.job.GetGceDiscovery().GetAppendDomain()) > 0 {
 			domainSuffix = fmt.Sprintf(".%s", lb.job.GetGceDiscovery().GetAppendDomain())
 		}
-		for _, backend := range newBackendList {
-			endpoint.Host = fmt.Sprintf("%s%s:%d",
-				backend.instanceName,
-				domainSuffix,
-				lb.job.GetGceDiscovery().GetPort())
-			t := NewTarget(endpoint.String(), lb.job.ScrapeTimeout(), baseLabels)
+
+		for _, inst := range running {
+			host, addrErr := instanceAddress(inst, addressType)
+			if addrErr != nil {
+				glog.Warningf("Skipping instance %s: %s", inst.Name, addrErr)
+				continue
+			}
+			if addressType == gceAddressTypeDns || len(host) == 0 {
+				host = fmt.Sprintf("%s%s", inst.Name, domainSuffix)
+			}
+			endpoint.Host = fmt.Sprintf("%s:%d", host, lb.job.GetGceDiscovery().GetPort())
+
+			targetLabels := clientmodel.LabelSet{}
+			for n, v := range baseLabels {
+				targetLabels[n] = v
+			}
+			for n, v := range instanceLabels(inst) {
+				targetLabels[n] = v
+			}
+
+			t := NewTarget(endpoint.String(), lb.job.ScrapeTimeout(), targetLabels)
 			targets = append(targets, t)
 		}
 	}
@@ -0,0 +1,97 @@
+package retrieval
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFanOutZoneListingMergesSuccessfulZones(t *testing.T) {
+	zones := []string{"us-central1-a", "us-central1-b", "us-central1-c"}
+
+	groups, err := fanOutZoneListing(zones, 2, func(zone string) ([]groupRef, error) {
+		return []groupRef{{zone: zone, name: "web"}}, nil
+	})
+	if err != nil {
+		t.Fatalf("fanOutZoneListing: %s", err)
+	}
+	if len(groups) != len(zones) {
+		t.Fatalf("got %d groups, want %d", len(groups), len(zones))
+	}
+}
+
+func TestFanOutZoneListingSkipsFailingZonesButKeepsTheRest(t *testing.T) {
+	zones := []string{"us-central1-a", "us-central1-b", "us-central1-c"}
+
+	groups, err := fanOutZoneListing(zones, 3, func(zone string) ([]groupRef, error) {
+		if zone == "us-central1-b" {
+			return nil, fmt.Errorf("zone disabled")
+		}
+		return []groupRef{{zone: zone, name: "web"}}, nil
+	})
+	if err != nil {
+		t.Fatalf("fanOutZoneListing returned an error even though two of three zones succeeded: %s", err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2 (one bad zone should have been skipped, not discarded everything)", len(groups))
+	}
+	for _, g := range groups {
+		if g.zone == "us-central1-b" {
+			t.Fatalf("got a group from the zone that failed to list: %+v", g)
+		}
+	}
+}
+
+func TestFanOutZoneListingFailsOnlyWhenEveryZoneFails(t *testing.T) {
+	zones := []string{"us-central1-a", "us-central1-b"}
+
+	_, err := fanOutZoneListing(zones, 2, func(zone string) ([]groupRef, error) {
+		return nil, fmt.Errorf("quota exceeded")
+	})
+	if err == nil {
+		t.Fatal("expected an error when every zone fails to list, got nil")
+	}
+}
+
+func TestFanOutZoneListingRespectsConcurrencyLimit(t *testing.T) {
+	const concurrency = 3
+	zones := make([]string, 20)
+	for i := range zones {
+		zones[i] = fmt.Sprintf("zone-%d", i)
+	}
+
+	var (
+		mu      sync.Mutex
+		current int
+		peak    int
+	)
+
+	_, err := fanOutZoneListing(zones, concurrency, func(zone string) ([]groupRef, error) {
+		mu.Lock()
+		current++
+		if current > peak {
+			peak = current
+		}
+		mu.Unlock()
+
+		// Give other goroutines a chance to pile up against the semaphore
+		// before this one finishes.
+		var n int32
+		for i := 0; i < 1000; i++ {
+			n = atomic.AddInt32(&n, 1)
+		}
+		_ = n
+
+		mu.Lock()
+		current--
+		mu.Unlock()
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("fanOutZoneListing: %s", err)
+	}
+	if peak > concurrency {
+		t.Fatalf("observed %d zones in flight at once, want at most %d", peak, concurrency)
+	}
+}
@@ -0,0 +1,124 @@
+package retrieval
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestBackoffDelayIsBoundedAndCapped(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := backoffDelay(attempt)
+		if delay <= 0 {
+			t.Errorf("attempt %d: backoffDelay returned non-positive delay %s", attempt, delay)
+		}
+		if delay > retryMaxDelay {
+			t.Errorf("attempt %d: backoffDelay returned %s, want at most retryMaxDelay (%s)", attempt, delay, retryMaxDelay)
+		}
+	}
+}
+
+func TestBackoffDelayGrowsWithAttempt(t *testing.T) {
+	// The jitter makes any single pair of attempts flaky to compare, so
+	// compare the minimum possible delay (no jitter) at each attempt, which
+	// is deterministic.
+	minDelay := func(attempt int) time.Duration {
+		delay := retryBaseDelay * time.Duration(uint64(1)<<uint(attempt))
+		if delay > retryMaxDelay || delay <= 0 {
+			delay = retryMaxDelay
+		}
+		return delay / 2
+	}
+
+	prev := minDelay(0)
+	for attempt := 1; attempt < 6; attempt++ {
+		cur := minDelay(attempt)
+		if cur < prev {
+			t.Errorf("attempt %d: minimum possible delay %s is less than attempt %d's %s", attempt, cur, attempt-1, prev)
+		}
+		if delay := backoffDelay(attempt); delay < cur || delay > 2*cur {
+			t.Errorf("attempt %d: backoffDelay returned %s, want between %s and %s", attempt, delay, cur, 2*cur)
+		}
+		prev = cur
+	}
+}
+
+type fakeNetError struct {
+	timeout   bool
+	temporary bool
+}
+
+func (e *fakeNetError) Error() string   { return "fake net error" }
+func (e *fakeNetError) Timeout() bool   { return e.timeout }
+func (e *fakeNetError) Temporary() bool { return e.temporary }
+
+func TestIsRetryableError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain error", errors.New("boom"), false},
+		{"temporary net error", &fakeNetError{temporary: true}, true},
+		{"timeout net error", &fakeNetError{timeout: true}, true},
+		{"non-temporary, non-timeout net error", &fakeNetError{}, false},
+		{"net error wrapped in url.Error", &url.Error{Op: "Get", URL: "http://x", Err: &fakeNetError{temporary: true}}, true},
+		{"googleapi 429", &googleapi.Error{Code: 429}, true},
+		{"googleapi 500", &googleapi.Error{Code: 500}, true},
+		{"googleapi 503", &googleapi.Error{Code: 503}, true},
+		{"googleapi 404", &googleapi.Error{Code: 404}, false},
+		{
+			"googleapi 403 rateLimitExceeded",
+			&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}},
+			true,
+		},
+		{
+			"googleapi 403 userRateLimitExceeded",
+			&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}},
+			true,
+		},
+		{
+			"googleapi 403 not a rate limit reason",
+			&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}},
+			false,
+		},
+		{"googleapi 403 with no errors", &googleapi.Error{Code: 403}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isRetryableError(c.err); got != c.want {
+				t.Errorf("isRetryableError(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestAsNetErrorUnwrapsURLError(t *testing.T) {
+	inner := &fakeNetError{temporary: true}
+
+	if _, ok := asNetError(errors.New("boom")); ok {
+		t.Error("asNetError matched a plain error")
+	}
+	if netErr, ok := asNetError(inner); !ok || netErr != net.Error(inner) {
+		t.Error("asNetError didn't match a bare net.Error")
+	}
+	wrapped := &url.Error{Op: "Get", URL: "http://x", Err: inner}
+	if netErr, ok := asNetError(wrapped); !ok || netErr != net.Error(inner) {
+		t.Error("asNetError didn't unwrap a net.Error out of a *url.Error")
+	}
+}
+
+func TestFailureReasonPrefersNetworkOverFallback(t *testing.T) {
+	if got := failureReason(&fakeNetError{temporary: true}, "list"); got != "network" {
+		t.Errorf("failureReason(net error, %q) = %q, want %q", "list", got, "network")
+	}
+	if got := failureReason(&googleapi.Error{Code: 500}, "list"); got != "list" {
+		t.Errorf("failureReason(non-net error, %q) = %q, want %q", "list", got, "list")
+	}
+}
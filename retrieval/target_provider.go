@@ -0,0 +1,73 @@
+package retrieval
+
+import (
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+// TargetProvider discovers the targets for a single job. Implementations are
+// free to cache results between calls (e.g. to survive a transient discovery
+// failure), but each call to Targets should reflect the provider's best
+// current knowledge of the job's scrape targets.
+type TargetProvider interface {
+	Targets() ([]Target, error)
+}
+
+// targetProviderFactory constructs a TargetProvider for a job, provided
+// detect reports that the job is configured for it.
+type targetProviderFactory struct {
+	// discriminator names the backend, e.g. "gce", "ec2", "k8s". The
+	// registry only stores it; detect decides which jobs a factory serves.
+	discriminator string
+	// detect reports whether job is configured to use this backend.
+	detect func(job config.JobConfig) bool
+	// new constructs the provider once detect has returned true.
+	new func(job config.JobConfig, globalLabels clientmodel.LabelSet) TargetProvider
+}
+
+var targetProviderFactories []targetProviderFactory
+
+// RegisterTargetProvider adds a cloud/service discovery backend to the
+// registry consulted by NewTargetProviders. Backends call this from an
+// init() function so that adding a new SD integration (AWS EC2, Azure VMSS,
+// Kubernetes endpoints, Consul, ...) never requires touching retrieval core.
+func RegisterTargetProvider(discriminator string, detect func(job config.JobConfig) bool, new func(job config.JobConfig, globalLabels clientmodel.LabelSet) TargetProvider) {
+	targetProviderFactories = append(targetProviderFactories, targetProviderFactory{
+		discriminator: discriminator,
+		detect:        detect,
+		new:           new,
+	})
+}
+
+// NewTargetProviders returns a TargetProvider for every registered discovery
+// backend that job is configured to use.
+func NewTargetProviders(job config.JobConfig, globalLabels clientmodel.LabelSet) []TargetProvider {
+	var providers []TargetProvider
+	for _, f := range targetProviderFactories {
+		if f.detect(job) {
+			providers = append(providers, f.new(job, globalLabels))
+		}
+	}
+	return providers
+}
+
+// DiscoverTargets resolves every scrape target for jobs by dispatching each
+// job to its registered TargetProvider(s). This is the entry point the
+// scrape manager calls on each discovery refresh; it's the only place in
+// retrieval core that needs to know the registry exists at all.
+func DiscoverTargets(jobs []config.JobConfig, globalLabels clientmodel.LabelSet) []Target {
+	var targets []Target
+	for _, job := range jobs {
+		for _, provider := range NewTargetProviders(job, globalLabels) {
+			jobTargets, err := provider.Targets()
+			if err != nil {
+				glog.Warningf("Target discovery failed for job %s: %s", job.GetName(), err)
+			}
+			targets = append(targets, jobTargets...)
+		}
+	}
+	return targets
+}
@@ -0,0 +1,80 @@
+package retrieval
+
+import (
+	"fmt"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+// withCleanRegistry runs fn against an empty targetProviderFactories
+// registry and restores whatever was registered (e.g. by the init() in
+// gce_instancegroup_provider.go) once fn returns, so tests don't leak state into each other or
+// depend on registration order.
+func withCleanRegistry(fn func()) {
+	orig := targetProviderFactories
+	targetProviderFactories = nil
+	defer func() { targetProviderFactories = orig }()
+	fn()
+}
+
+type fakeTargetProvider struct {
+	targets []Target
+	err     error
+}
+
+func (p *fakeTargetProvider) Targets() ([]Target, error) {
+	return p.targets, p.err
+}
+
+func TestNewTargetProvidersDispatchesOnlyToMatchingFactories(t *testing.T) {
+	withCleanRegistry(func() {
+		var job config.JobConfig
+
+		RegisterTargetProvider("match-a",
+			func(config.JobConfig) bool { return true },
+			func(config.JobConfig, clientmodel.LabelSet) TargetProvider { return &fakeTargetProvider{} })
+		RegisterTargetProvider("match-b",
+			func(config.JobConfig) bool { return true },
+			func(config.JobConfig, clientmodel.LabelSet) TargetProvider { return &fakeTargetProvider{} })
+		RegisterTargetProvider("no-match",
+			func(config.JobConfig) bool { return false },
+			func(config.JobConfig, clientmodel.LabelSet) TargetProvider {
+				t.Fatal("new() called for a factory whose detect() returned false")
+				return nil
+			})
+
+		providers := NewTargetProviders(job, clientmodel.LabelSet{})
+		if len(providers) != 2 {
+			t.Fatalf("got %d providers, want 2 (one per matching factory)", len(providers))
+		}
+	})
+}
+
+func TestDiscoverTargetsAggregatesAcrossJobsAndProviders(t *testing.T) {
+	withCleanRegistry(func() {
+		RegisterTargetProvider("ok",
+			func(config.JobConfig) bool { return true },
+			func(config.JobConfig, clientmodel.LabelSet) TargetProvider {
+				return &fakeTargetProvider{targets: make([]Target, 2)}
+			})
+		RegisterTargetProvider("failing",
+			func(config.JobConfig) bool { return true },
+			func(config.JobConfig, clientmodel.LabelSet) TargetProvider {
+				return &fakeTargetProvider{err: fmt.Errorf("discovery broke")}
+			})
+
+		jobs := []config.JobConfig{{}, {}}
+		targets := DiscoverTargets(jobs, clientmodel.LabelSet{})
+
+		// Each job has two registered factories ("ok" and "failing"); "ok"
+		// contributes 2 targets per job and "failing" contributes none (its
+		// error is logged, not fatal to the other provider's results).
+		want := 2 * len(jobs)
+		if len(targets) != want {
+			t.Fatalf("got %d targets, want %d (a failing provider should not drop the other provider's targets)", len(targets), want)
+		}
+	})
+}